@@ -0,0 +1,150 @@
+// Package diagnostic implements HTTP handlers for operators to inspect a
+// running bridge. These endpoints are intentionally served on a separate
+// listener from the HAP mux, since HomeKit controllers reject any path they
+// don't recognize and would treat /debug/* as a protocol error.
+package diagnostic
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"sync"
+)
+
+// ConnStats is a snapshot of the byte counters for one active connection, as
+// reported by /debug/hap/connections.
+type ConnStats struct {
+	RemoteAddr string `json:"remote_addr"`
+	BytesIn    uint64 `json:"bytes_in"`
+	BytesOut   uint64 `json:"bytes_out"`
+}
+
+// Stats is the aggregate snapshot reported by /debug/hap/stats.
+type Stats struct {
+	ActiveConnections int `json:"active_connections"`
+}
+
+// Registry is the single source of truth for everything the diagnostic
+// endpoints report. The server package feeds it real per-connection byte
+// counts by wrapping the HAP listener's Accept.
+//
+// Only connection lifetimes and byte counts are tracked. Pair-verify
+// success/failure, per-AID.IID characteristic read/write counts and
+// event-notification queue depth are not recorded or reported.
+type Registry struct {
+	mu    sync.Mutex
+	conns map[uint64]*ConnStats
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		conns: make(map[uint64]*ConnStats),
+	}
+}
+
+// Open registers a newly accepted connection under id, identified by
+// remoteAddr (e.g. conn.RemoteAddr().String()).
+func (r *Registry) Open(id uint64, remoteAddr string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.conns[id] = &ConnStats{RemoteAddr: remoteAddr}
+}
+
+// Close removes id from the set of active connections.
+func (r *Registry) Close(id uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.conns, id)
+}
+
+// AddBytesIn adds n to id's inbound byte counter.
+func (r *Registry) AddBytesIn(id uint64, n uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if c, ok := r.conns[id]; ok {
+		c.BytesIn += n
+	}
+}
+
+// AddBytesOut adds n to id's outbound byte counter.
+func (r *Registry) AddBytesOut(id uint64, n uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if c, ok := r.conns[id]; ok {
+		c.BytesOut += n
+	}
+}
+
+// Connections returns a snapshot of every currently open connection.
+func (r *Registry) Connections() []ConnStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	conns := make([]ConnStats, 0, len(r.conns))
+	for _, c := range r.conns {
+		conns = append(conns, *c)
+	}
+
+	return conns
+}
+
+// Stats returns a snapshot of the aggregate counters.
+func (r *Registry) Stats() Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return Stats{ActiveConnections: len(r.conns)}
+}
+
+// StatsHandler serves a Registry's Stats as JSON at /debug/hap/stats.
+type StatsHandler struct {
+	registry *Registry
+}
+
+// NewStatsHandler returns a handler for /debug/hap/stats.
+func NewStatsHandler(registry *Registry) *StatsHandler {
+	return &StatsHandler{registry: registry}
+}
+
+func (h *StatsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.registry.Stats())
+}
+
+// ConnectionsHandler lists a Registry's open connections as JSON at
+// /debug/hap/connections.
+type ConnectionsHandler struct {
+	registry *Registry
+}
+
+// NewConnectionsHandler returns a handler for /debug/hap/connections.
+func NewConnectionsHandler(registry *Registry) *ConnectionsHandler {
+	return &ConnectionsHandler{registry: registry}
+}
+
+func (h *ConnectionsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.registry.Connections())
+}
+
+// NewMux returns the handler serving the diagnostic endpoints plus a mounted
+// net/http/pprof handler, for use on a separate listener from the HAP mux.
+func NewMux(registry *Registry) *http.ServeMux {
+	mux := http.NewServeMux()
+
+	mux.Handle("/debug/hap/stats", NewStatsHandler(registry))
+	mux.Handle("/debug/hap/connections", NewConnectionsHandler(registry))
+
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	return mux
+}
@@ -0,0 +1,48 @@
+package diagnostic
+
+import "testing"
+
+func TestRegistryConnectionLifecycle(t *testing.T) {
+	r := NewRegistry()
+
+	r.Open(1, "10.0.0.5:54321")
+	r.AddBytesIn(1, 100)
+	r.AddBytesOut(1, 42)
+
+	conns := r.Connections()
+	if len(conns) != 1 {
+		t.Fatalf("expected 1 open connection, got %d", len(conns))
+	}
+
+	c := conns[0]
+	if c.RemoteAddr != "10.0.0.5:54321" || c.BytesIn != 100 || c.BytesOut != 42 {
+		t.Fatalf("unexpected connection stats: %+v", c)
+	}
+
+	r.Close(1)
+
+	if conns := r.Connections(); len(conns) != 0 {
+		t.Fatalf("expected 0 open connections after Close, got %d", len(conns))
+	}
+}
+
+func TestRegistryStats(t *testing.T) {
+	r := NewRegistry()
+
+	r.Open(1, "10.0.0.5:1")
+	r.Open(2, "10.0.0.6:1")
+
+	stats := r.Stats()
+
+	if stats.ActiveConnections != 2 {
+		t.Fatalf("expected 2 active connections, got %d", stats.ActiveConnections)
+	}
+}
+
+func TestAddBytesUnknownConnection(t *testing.T) {
+	r := NewRegistry()
+
+	// Must not panic when the connection was never opened (or already closed).
+	r.AddBytesIn(99, 10)
+	r.AddBytesOut(99, 10)
+}
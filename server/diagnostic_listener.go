@@ -0,0 +1,69 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/brutella/hc/endpoint/diagnostic"
+)
+
+// countingListener wraps a net.Listener and reports every accepted
+// connection, plus the bytes it moves, to a diagnostic.Registry. It sits on
+// the outside of netio.NewHAPTCPListener (and any TLS wrapping beneath it),
+// so it sees exactly the bytes http.Server reads and writes: after netio's
+// session cipher and TLS, not the encrypted bytes on the wire.
+type countingListener struct {
+	net.Listener
+	registry *diagnostic.Registry
+	nextID   uint64
+}
+
+func newCountingListener(ln net.Listener, registry *diagnostic.Registry) net.Listener {
+	return &countingListener{Listener: ln, registry: registry}
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	id := atomic.AddUint64(&l.nextID, 1)
+	l.registry.Open(id, conn.RemoteAddr().String())
+
+	return &countingConn{Conn: conn, id: id, registry: l.registry}, nil
+}
+
+// countingConn wraps a net.Conn, reporting bytes read/written and the
+// connection's lifetime to a diagnostic.Registry.
+type countingConn struct {
+	net.Conn
+	id        uint64
+	registry  *diagnostic.Registry
+	closeOnce sync.Once
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.registry.AddBytesIn(c.id, uint64(n))
+	}
+
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.registry.AddBytesOut(c.id, uint64(n))
+	}
+
+	return n, err
+}
+
+func (c *countingConn) Close() error {
+	c.closeOnce.Do(func() { c.registry.Close(c.id) })
+
+	return c.Conn.Close()
+}
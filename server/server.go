@@ -2,38 +2,93 @@ package server
 
 import (
 	"github.com/brutella/hc/db"
+	"github.com/brutella/hc/endpoint/diagnostic"
 	"github.com/brutella/hc/model/container"
 	"github.com/brutella/hc/netio"
 	"github.com/brutella/hc/netio/controller"
 	"github.com/brutella/hc/netio/endpoint"
 	"github.com/brutella/hc/netio/pair"
 
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"os/exec"
 	"os/signal"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 // Server provides a similar interfaces as http.Server to start and stop a TCP server.
 type Server interface {
-	// ListenAndServe start the server
-	ListenAndServe() error
+	// ListenAndServe starts the server and blocks until ctx is cancelled, at
+	// which point in-flight HAP sessions are given a chance to finish via
+	// http.Server.Shutdown before ListenAndServe returns. It also returns nil,
+	// with ctx still live, once Reload has shut the server down.
+	ListenAndServe(ctx context.Context) error
 
 	// Port returns the port on which the server listens to
 	Port() string
 
-	// OnStop calls the function when the server stops
-	OnStop(fn ExitFunc)
+	// Reload re-execs the process, handing the listening socket off to the
+	// child so the bridge keeps its port and existing connections can drain.
+	Reload() error
+}
+
+// GracefulConfig configures the graceful-restart behavior triggered by SIGHUP.
+type GracefulConfig struct {
+	// HammerTime is how long the parent waits for in-flight HAP connections
+	// to drain after re-exec'ing the child before it forcibly closes them.
+	// A value <= 0 falls back to a default of 15s.
+	HammerTime time.Duration
+}
+
+func (c GracefulConfig) hammerTime() time.Duration {
+	if c.HammerTime <= 0 {
+		return 15 * time.Second
+	}
 
-	// Stop stops the server
-	Stop()
+	return c.HammerTime
 }
 
-// ExitFunc is the function which is invoked when the server shuts down.
-type ExitFunc func()
+// DiagnosticOptions configures the optional diagnostic/metrics endpoints.
+type DiagnosticOptions struct {
+	// Addr is the address (e.g. ":6065") the diagnostic server listens on.
+	// Leave empty to disable it entirely.
+	Addr string
+}
+
+const (
+	// listenFDsEnv tells a re-exec'd child how many listening sockets it inherits.
+	listenFDsEnv = "HC_LISTEN_FDS"
+	// listenNamesEnv maps each inherited FD (starting at listenFDsOffset) to the
+	// bridge name it belongs to, so accessories keep their own port across restart.
+	listenNamesEnv = "HC_LISTEN_NAMES"
+	// listenFDsOffset is the first inherited file descriptor (0, 1, 2 are stdio).
+	listenFDsOffset = 3
+
+	// systemdListenFDsEnv, systemdListenPIDEnv and systemdListenFDNamesEnv are
+	// the env vars systemd sets for socket-activated units (sd_listen_fds(3)).
+	// They're distinct from listenFDsEnv/listenNamesEnv above, which are this
+	// package's own protocol for handing a listener to a child re-exec'd by
+	// Reload. systemdListenFDNamesEnv is only set when the unit configures
+	// FileDescriptorName=, which is how systemd maps each FD (starting at
+	// systemdListenFDsOffset) to a specific socket when a unit owns more than one.
+	systemdListenFDsEnv     = "LISTEN_FDS"
+	systemdListenPIDEnv     = "LISTEN_PID"
+	systemdListenFDNamesEnv = "LISTEN_FDNAMES"
+	// systemdListenFDsOffset is the first socket-activated file descriptor.
+	systemdListenFDsOffset = 3
+)
 
 type hkServer struct {
 	context  netio.HAPContext
@@ -41,7 +96,19 @@ type hkServer struct {
 	bridge   *netio.Bridge
 	mux      *http.ServeMux
 
-	exitFunc ExitFunc
+	graceful  GracefulConfig
+	tlsConfig *tls.Config
+
+	// lifecycleMu guards httpServer and diagServer, since they're written by
+	// ListenAndServe (running in whatever goroutine the caller drives it
+	// from) and read by shutdownAfterReload (running in the goroutine
+	// Reload starts for it).
+	lifecycleMu sync.Mutex
+	httpServer  *http.Server
+	diagServer  *http.Server
+
+	diagnostic DiagnosticOptions
+	diagReg    *diagnostic.Registry
 
 	mutex     *sync.Mutex
 	container *container.Container
@@ -50,83 +117,454 @@ type hkServer struct {
 	listener *net.TCPListener
 }
 
-// NewServer returns a server
-func NewServer(ctx netio.HAPContext, d db.Database, c *container.Container, b *netio.Bridge, mutex *sync.Mutex) Server {
-	// os gives us a free Port when Port is ""
-	ln, err := net.Listen("tcp", "")
+// activeServers tracks every server created in this process so that Reload
+// can hand off all of their listeners to the re-exec'd child in one go, and
+// so a restart shuts every one of them down gracefully rather than just the
+// server instance that happened to receive SIGHUP.
+var (
+	activeServersMutex sync.Mutex
+	activeServers      []*hkServer
+)
+
+// NewServer returns a server. tlsConfig is optional (may be nil) and, when
+// set, wraps the HAP endpoints in standard TLS – e.g. for deployments that
+// tunnel HAP behind a reverse proxy. Build one with NewTLSConfig. The plain
+// TCP path used by ordinary iOS controllers is unaffected when tlsConfig is nil.
+func NewServer(ctx netio.HAPContext, d db.Database, c *container.Container, b *netio.Bridge, mutex *sync.Mutex, graceful GracefulConfig, tlsConfig *tls.Config, diag DiagnosticOptions) Server {
+	ln, err := listenerFromEnv(b.Name())
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	if ln == nil {
+		ln, err = listenerFromSystemd(b.Name())
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if ln == nil {
+		// os gives us a free Port when Port is ""
+		tln, err := net.Listen("tcp", "")
+		if err != nil {
+			log.Fatal(err)
+		}
+		ln = tln.(*net.TCPListener)
+	}
+
 	port := ExtractPort(ln.Addr())
 
 	s := hkServer{
-		context:   ctx,
-		database:  d,
-		container: c,
-		bridge:    b,
-		mux:       http.NewServeMux(),
-		mutex:     mutex,
-		listener:  ln.(*net.TCPListener),
-		port:      port,
+		context:    ctx,
+		database:   d,
+		container:  c,
+		bridge:     b,
+		mux:        http.NewServeMux(),
+		mutex:      mutex,
+		listener:   ln,
+		port:       port,
+		graceful:   graceful,
+		tlsConfig:  tlsConfig,
+		diagnostic: diag,
+		diagReg:    diagnostic.NewRegistry(),
 	}
 
 	s.setupEndpoints()
 
+	activeServersMutex.Lock()
+	activeServers = append(activeServers, &s)
+	activeServersMutex.Unlock()
+
 	return &s
 }
 
-func (s *hkServer) OnStop(fn ExitFunc) {
-	s.exitFunc = fn
+// setHTTPServer records the *http.Server ListenAndServe is about to run, so
+// shutdownAfterReload can find and shut it down from another goroutine.
+func (s *hkServer) setHTTPServer(srv *http.Server) {
+	s.lifecycleMu.Lock()
+	s.httpServer = srv
+	s.lifecycleMu.Unlock()
+}
+
+// getHTTPServer returns the server's current *http.Server, or nil if
+// ListenAndServe hasn't started it yet.
+func (s *hkServer) getHTTPServer() *http.Server {
+	s.lifecycleMu.Lock()
+	defer s.lifecycleMu.Unlock()
+
+	return s.httpServer
+}
+
+// setDiagServer records the *http.Server ListenAndServe is about to run for
+// the diagnostic endpoints, so shutdownAfterReload can find and shut it
+// down from another goroutine.
+func (s *hkServer) setDiagServer(srv *http.Server) {
+	s.lifecycleMu.Lock()
+	s.diagServer = srv
+	s.lifecycleMu.Unlock()
+}
+
+// getDiagServer returns the server's current diagnostic *http.Server, or nil
+// if diagnostics are disabled or ListenAndServe hasn't started it yet.
+func (s *hkServer) getDiagServer() *http.Server {
+	s.lifecycleMu.Lock()
+	defer s.lifecycleMu.Unlock()
+
+	return s.diagServer
+}
+
+// listenerFromEnv adopts the inherited listener for name, as set up by a
+// parent that re-exec'd via Reload(). It returns a nil listener, nil error
+// when no handoff is in progress so the caller falls back to net.Listen.
+func listenerFromEnv(name string) (*net.TCPListener, error) {
+	index, ok := selectEnvFD(name)
+	if !ok {
+		return nil, nil
+	}
+
+	ln, err := adoptListenerFD(uintptr(listenFDsOffset+index), name)
+	if err != nil {
+		return nil, fmt.Errorf("server: failed to adopt inherited listener for %s: %s", name, err)
+	}
+
+	return ln, nil
+}
+
+// selectEnvFD returns the index (relative to listenFDsOffset) of the
+// inherited FD that belongs to name, as recorded in listenFDsEnv/
+// listenNamesEnv by a parent's Reload(). ok is false when no handoff for
+// name is in progress.
+func selectEnvFD(name string) (index int, ok bool) {
+	count, err := strconv.Atoi(os.Getenv(listenFDsEnv))
+	if err != nil || count <= 0 {
+		return 0, false
+	}
+
+	names := strings.Split(os.Getenv(listenNamesEnv), ",")
+	for i, n := range names {
+		if n == name && i < count {
+			return i, true
+		}
+	}
+
+	return 0, false
+}
+
+// listenerFromSystemd adopts the listener that systemd socket-activated for
+// name, per sd_listen_fds(3). It returns a nil listener, nil error when
+// socket activation isn't in effect, so the caller falls back to net.Listen.
+func listenerFromSystemd(name string) (*net.TCPListener, error) {
+	index, fdName, ok, err := selectSystemdFD(name)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	ln, err := adoptListenerFD(uintptr(systemdListenFDsOffset+index), fdName)
+	if err != nil {
+		return nil, fmt.Errorf("server: failed to adopt systemd-activated listener: %s", err)
+	}
+
+	return ln, nil
+}
+
+// systemdUnnamedClaimed guards the no-FileDescriptorName= case below, so that
+// with a single socket-activated FD and multiple bridges in one process only
+// the first NewServer call claims it; the rest fall back to net.Listen.
+var systemdUnnamedClaimed int32
+
+// selectSystemdFD decides which inherited FD (relative to
+// systemdListenFDsOffset), if any, belongs to name. When the unit sets
+// LISTEN_FDNAMES, FDs are matched by name, so any number of sockets can be
+// mapped to their bridges, exactly like selectEnvFD. Without it, systemd
+// only promises a single socket, which the first caller claims.
+func selectSystemdFD(name string) (index int, fdName string, ok bool, err error) {
+	pid, err := strconv.Atoi(os.Getenv(systemdListenPIDEnv))
+	if err != nil || pid != os.Getpid() {
+		return 0, "", false, nil
+	}
+
+	count, err := strconv.Atoi(os.Getenv(systemdListenFDsEnv))
+	if err != nil || count < 1 {
+		return 0, "", false, nil
+	}
+
+	if namesEnv := os.Getenv(systemdListenFDNamesEnv); namesEnv != "" {
+		names := strings.Split(namesEnv, ":")
+		for i, n := range names {
+			if n == name && i < count {
+				return i, n, true, nil
+			}
+		}
+
+		return 0, "", false, nil
+	}
+
+	if count != 1 {
+		return 0, "", false, fmt.Errorf("server: %d systemd sockets passed without %s to map them to bridges", count, systemdListenFDNamesEnv)
+	}
+
+	if !atomic.CompareAndSwapInt32(&systemdUnnamedClaimed, 0, 1) {
+		return 0, "", false, nil
+	}
+
+	return 0, "LISTEN_FD_3", true, nil
+}
+
+// adoptListenerFD wraps the open file descriptor fd as a *net.TCPListener.
+// name is only used to label the resulting *os.File for diagnostics.
+func adoptListenerFD(fd uintptr, name string) (*net.TCPListener, error) {
+	f := os.NewFile(fd, name)
+
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, err
+	}
+
+	tln, ok := ln.(*net.TCPListener)
+	if !ok {
+		return nil, fmt.Errorf("inherited listener for %s is not a TCP listener", name)
+	}
+
+	return tln, nil
+}
+
+// NewTLSConfig builds a *tls.Config for use with NewServer from a PEM-encoded
+// certificate chain and private key. Every CERTIFICATE block in certPEM is
+// parsed, not just the first, so callers can pass a full chain (leaf plus
+// intermediates) in one file; the leaf must match hostname or it is rejected.
+func NewTLSConfig(certPEM, keyPEM []byte, hostname string) (*tls.Config, error) {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("server: failed to load TLS key pair: %s", err)
+	}
+
+	var chain []*x509.Certificate
+	rest := certPEM
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		c, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("server: failed to parse certificate: %s", err)
+		}
+
+		chain = append(chain, c)
+	}
+
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("server: no certificates found in PEM data")
+	}
+
+	if err := chain[0].VerifyHostname(hostname); err != nil {
+		return nil, fmt.Errorf("server: certificate does not match bridge hostname %q: %s", hostname, err)
+	}
+
+	cert.Leaf = chain[0]
+
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
 }
 
-func (s *hkServer) ListenAndServe() error {
-	s.teardownOnStop()
+// wrapTLS wraps raw in a TLS listener when tlsConfig is set. It must be
+// applied *beneath* netio.NewHAPTCPListener (i.e. called on the raw TCP
+// listener, with its result passed into NewHAPTCPListener, not the other
+// way around): netio installs its pair-verify session cipher on the conn
+// object it's handed, so that conn has to be the same one http.Server
+// actually reads and writes through. Wrapping TLS on the outside instead
+// would let netio track the plain TCP conn while the handler only ever
+// sees the tls.Conn sitting on top of it.
+func wrapTLS(raw net.Listener, tlsConfig *tls.Config) net.Listener {
+	if tlsConfig == nil {
+		return raw
+	}
 
-	return s.listenAndServe(s.addrString(), s.mux, s.context)
+	return tls.NewListener(raw, tlsConfig)
 }
 
-func (s *hkServer) Stop() {
-	for _, c := range s.context.ActiveConnections() {
-		c.Close()
+// ListenAndServe starts serving HAP requests and blocks until ctx is
+// cancelled. On cancellation it calls http.Server.Shutdown so connections
+// currently handling a request can finish instead of being hard-closed.
+// It also returns nil when Reload shuts the server down.
+func (s *hkServer) ListenAndServe(ctx context.Context) error {
+	s.watchForReload()
+
+	srv := &http.Server{Addr: s.addrString(), Handler: s.mux}
+	s.setHTTPServer(srv)
+
+	listener := netio.NewHAPTCPListener(wrapTLS(s.listener, s.tlsConfig), s.context)
+
+	var diagServer *http.Server
+	if s.diagnostic.Addr != "" {
+		listener = newCountingListener(listener, s.diagReg)
+
+		diagServer = &http.Server{Addr: s.diagnostic.Addr, Handler: diagnostic.NewMux(s.diagReg)}
+		s.setDiagServer(diagServer)
+
+		go func() {
+			log.Printf("[INFO] Diagnostic endpoints listening on %s", s.diagnostic.Addr)
+
+			if err := diagServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Println("[ERRO] diagnostic server:", err)
+			}
+		}()
 	}
 
-	if s.exitFunc != nil {
-		s.exitFunc()
+	go func() {
+		<-ctx.Done()
+		log.Println("[INFO] Shutting down server")
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), s.graceful.hammerTime())
+		defer cancel()
+
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Println("[ERRO]", err)
+		}
+
+		if diagServer != nil {
+			if err := diagServer.Shutdown(shutdownCtx); err != nil {
+				log.Println("[ERRO]", err)
+			}
+		}
+	}()
+
+	err := srv.Serve(listener)
+	if err == http.ErrServerClosed {
+		return nil
 	}
+
+	return err
 }
 
 func (s *hkServer) Port() string {
 	return s.port
 }
 
+// Reload re-execs the process via exec.LookPath(os.Args[0]), passing every
+// active server's listening socket to the child through ExtraFiles along
+// with HC_LISTEN_FDS/HC_LISTEN_NAMES so it can adopt them in NewServer. Once
+// the child has started, every active server stops accepting new connections
+// and drains its existing ones for up to its own graceful.HammerTime via
+// http.Server.Shutdown, so pairings and in-flight HAP sessions survive the
+// restart and one bridge's restart can't cut another bridge's connections short.
+func (s *hkServer) Reload() error {
+	activeServersMutex.Lock()
+	servers := append([]*hkServer(nil), activeServers...)
+	activeServersMutex.Unlock()
+
+	files := make([]*os.File, 0, len(servers))
+	names := make([]string, 0, len(servers))
+	for _, srv := range servers {
+		f, err := srv.listener.File()
+		if err != nil {
+			return fmt.Errorf("server: failed to dup listener for %s: %s", srv.bridge.Name(), err)
+		}
+
+		files = append(files, f)
+		names = append(names, srv.bridge.Name())
+	}
+
+	exe, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		return fmt.Errorf("server: failed to resolve executable: %s", err)
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("%s=%d", listenFDsEnv, len(files)),
+		fmt.Sprintf("%s=%s", listenNamesEnv, strings.Join(names, ",")),
+	)
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("server: failed to re-exec: %s", err)
+	}
+
+	log.Printf("[INFO] Re-exec'd as pid %d, shutting down %d server(s)", cmd.Process.Pid, len(servers))
+
+	go shutdownAfterReload(servers)
+
+	return nil
+}
+
+// shutdownAfterReload stops every server from accepting new connections and
+// lets their in-flight requests finish, each within its own hammer time,
+// once Reload's child has taken over the listening sockets. It also shuts
+// down each server's diagnostic server, if any, so the re-exec'd child can
+// bind DiagnosticAddr instead of failing with "address already in use". A
+// server whose ListenAndServe hasn't run yet (so it never bound an
+// *http.Server) has nothing to shut down and is skipped rather than raced.
+func shutdownAfterReload(servers []*hkServer) {
+	var wg sync.WaitGroup
+
+	for _, srv := range servers {
+		httpServer := srv.getHTTPServer()
+		if httpServer == nil {
+			continue
+		}
+
+		wg.Add(1)
+		go func(srv *hkServer, httpServer *http.Server) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(context.Background(), srv.graceful.hammerTime())
+			defer cancel()
+
+			if err := httpServer.Shutdown(ctx); err != nil {
+				log.Println("[ERRO]", err)
+				httpServer.Close()
+			}
+
+			if diagServer := srv.getDiagServer(); diagServer != nil {
+				if err := diagServer.Shutdown(ctx); err != nil {
+					log.Println("[ERRO]", err)
+				}
+			}
+		}(srv, httpServer)
+	}
+
+	wg.Wait()
+}
+
 // dnssdCommand returns a dns-sd command string to publish the server via dns-sd on OS X
 func (s *hkServer) dnssdCommand() string {
 	hostname, _ := os.Hostname()
 	return fmt.Sprintf("dns-sd -P %s _hap local %s %s 192.168.0.14 pv=1.0 id=%s c#=1 s#=1 sf=1 ff=0 md=%s\n", s.bridge.Name(), s.port, hostname, s.bridge.ID(), s.bridge.Name())
 }
 
-// listenAndServe returns a http.Server to listen on a specific address
-func (s *hkServer) listenAndServe(addr string, handler http.Handler, context netio.HAPContext) error {
-	server := http.Server{Addr: addr, Handler: handler}
-	// Use a HAPTCPListener
-	listener := netio.NewHAPTCPListener(s.listener, context)
-	return server.Serve(listener)
-}
+// reloadSignalOnce ensures only one SIGHUP watcher is installed for the
+// whole process: Reload already hands off every active server's listener in
+// one go, so if each server installed its own watcher a single SIGHUP would
+// fan out to all of them and re-exec the process once per bridge.
+var reloadSignalOnce sync.Once
 
-// teardownOnStop calls Stop on interrupt or kill signals
-func (s *hkServer) teardownOnStop() {
-	c := make(chan os.Signal)
-	signal.Notify(c, os.Interrupt)
-	signal.Notify(c, os.Kill)
+// watchForReload triggers a graceful restart via Reload whenever the process
+// receives SIGHUP. Unlike SIGINT/SIGTERM, which the caller now owns via ctx
+// cancellation passed to ListenAndServe, SIGHUP is specific to this
+// HAP-socket-handoff subsystem, so the server keeps handling it internally.
+func (s *hkServer) watchForReload() {
+	reloadSignalOnce.Do(func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
 
-	go func() {
-		select {
-		case <-c:
-			log.Println("[INFO] Teardown server")
-			s.Stop()
-			os.Exit(1)
-		}
-	}()
+		go func() {
+			for range hup {
+				log.Println("[INFO] Received SIGHUP, starting graceful restart")
+				if err := s.Reload(); err != nil {
+					log.Println("[ERRO]", err)
+				}
+			}
+		}()
+	})
 }
 
 func (s *hkServer) addrString() string {
@@ -0,0 +1,260 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func generateTestCert(t *testing.T, hostname string) (certPEM, keyPEM []byte) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: hostname},
+		DNSNames:     []string{hostname},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %s", err)
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	return certPEM, keyPEM
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	certPEM, keyPEM := generateTestCert(t, "bridge.local")
+
+	cfg, err := NewTLSConfig(certPEM, keyPEM, "bridge.local")
+	if err != nil {
+		t.Fatalf("NewTLSConfig returned error for a matching hostname: %s", err)
+	}
+
+	if len(cfg.Certificates) != 1 {
+		t.Fatalf("expected 1 certificate, got %d", len(cfg.Certificates))
+	}
+}
+
+func TestNewTLSConfig_HostnameMismatch(t *testing.T) {
+	certPEM, keyPEM := generateTestCert(t, "bridge.local")
+
+	if _, err := NewTLSConfig(certPEM, keyPEM, "other.local"); err == nil {
+		t.Fatal("expected an error for a hostname that doesn't match the certificate")
+	}
+}
+
+func TestNewTLSConfig_MultiBlockChain(t *testing.T) {
+	leafPEM, keyPEM := generateTestCert(t, "bridge.local")
+	intermediatePEM, _ := generateTestCert(t, "intermediate-ca")
+
+	chain := append(append([]byte{}, leafPEM...), intermediatePEM...)
+
+	cfg, err := NewTLSConfig(chain, keyPEM, "bridge.local")
+	if err != nil {
+		t.Fatalf("NewTLSConfig returned error for a valid multi-block chain: %s", err)
+	}
+
+	if len(cfg.Certificates[0].Certificate) != 2 {
+		t.Fatalf("expected the full 2-certificate chain to be kept, got %d", len(cfg.Certificates[0].Certificate))
+	}
+
+	if cfg.Certificates[0].Leaf == nil || cfg.Certificates[0].Leaf.Subject.CommonName != "bridge.local" {
+		t.Fatalf("expected Leaf to be the bridge.local certificate, got %+v", cfg.Certificates[0].Leaf)
+	}
+}
+
+func TestNewTLSConfig_NoCertificates(t *testing.T) {
+	_, keyPEM := generateTestCert(t, "bridge.local")
+
+	if _, err := NewTLSConfig([]byte("not a certificate"), keyPEM, "bridge.local"); err == nil {
+		t.Fatal("expected an error when certPEM has no certificates")
+	}
+}
+
+// TestWrapTLS_Serves exercises the actual wiring ListenAndServe relies on:
+// wrapTLS'd listener, serving real bytes over a real TLS connection. This
+// stops at wrapTLS rather than going through netio.NewHAPTCPListener, but
+// it's the seam most likely to break —
+// it's exactly where the earlier bug (TLS wrapping netio instead of the
+// other way around) lived.
+func TestWrapTLS_Serves(t *testing.T) {
+	certPEM, keyPEM := generateTestCert(t, "bridge.local")
+
+	tlsConfig, err := NewTLSConfig(certPEM, keyPEM, "bridge.local")
+	if err != nil {
+		t.Fatalf("NewTLSConfig returned error: %s", err)
+	}
+
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to create test listener: %s", err)
+	}
+
+	ln := wrapTLS(raw, tlsConfig)
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		buf := make([]byte, len("ping"))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+
+		conn.Write([]byte("pong"))
+	}()
+
+	conn, err := tls.Dial("tcp", raw.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("tls.Dial failed against the wrapped listener: %s", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("failed to write over the TLS connection: %s", err)
+	}
+
+	buf := make([]byte, len("pong"))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("failed to read the server's response: %s", err)
+	}
+
+	if string(buf) != "pong" {
+		t.Fatalf("expected \"pong\", got %q", buf)
+	}
+}
+
+func TestWrapTLS_NoConfigPassesThrough(t *testing.T) {
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to create test listener: %s", err)
+	}
+	defer raw.Close()
+
+	if ln := wrapTLS(raw, nil); ln != raw {
+		t.Fatal("expected wrapTLS to return the raw listener unchanged when tlsConfig is nil")
+	}
+}
+
+func TestSelectEnvFD(t *testing.T) {
+	t.Setenv(listenFDsEnv, "2")
+	t.Setenv(listenNamesEnv, "kitchen,living-room")
+
+	if index, ok := selectEnvFD("living-room"); !ok || index != 1 {
+		t.Fatalf("expected index 1, ok=true, got index=%d, ok=%v", index, ok)
+	}
+
+	if _, ok := selectEnvFD("bathroom"); ok {
+		t.Fatal("expected ok=false for a name that isn't in the handoff")
+	}
+}
+
+func TestSelectEnvFD_NoHandoff(t *testing.T) {
+	os.Unsetenv(listenFDsEnv)
+	os.Unsetenv(listenNamesEnv)
+
+	if _, ok := selectEnvFD("kitchen"); ok {
+		t.Fatal("expected ok=false when HC_LISTEN_FDS isn't set")
+	}
+}
+
+func TestSelectSystemdFD_PIDMismatch(t *testing.T) {
+	t.Setenv(systemdListenPIDEnv, "1")
+	t.Setenv(systemdListenFDsEnv, "1")
+
+	_, _, ok, err := selectSystemdFD("kitchen")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if ok {
+		t.Fatal("expected ok=false when LISTEN_PID doesn't match the current process")
+	}
+}
+
+func TestSelectSystemdFD_Unnamed(t *testing.T) {
+	systemdUnnamedClaimed = 0
+
+	t.Setenv(systemdListenPIDEnv, strconv.Itoa(os.Getpid()))
+	t.Setenv(systemdListenFDsEnv, "1")
+	os.Unsetenv(systemdListenFDNamesEnv)
+
+	index, name, ok, err := selectSystemdFD("kitchen")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !ok || index != 0 || name == "" {
+		t.Fatalf("expected the single socket-activated FD to be claimed, got index=%d name=%q ok=%v", index, name, ok)
+	}
+
+	// A second bridge in the same process must not also claim FD 3.
+	if _, _, ok, _ := selectSystemdFD("living-room"); ok {
+		t.Fatal("expected the unnamed systemd socket to only be claimable once")
+	}
+}
+
+func TestSelectSystemdFD_Named(t *testing.T) {
+	t.Setenv(systemdListenPIDEnv, strconv.Itoa(os.Getpid()))
+	t.Setenv(systemdListenFDsEnv, "2")
+	t.Setenv(systemdListenFDNamesEnv, "kitchen:living-room")
+
+	index, name, ok, err := selectSystemdFD("living-room")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !ok || index != 1 || name != "living-room" {
+		t.Fatalf("expected index=1 name=living-room ok=true, got index=%d name=%q ok=%v", index, name, ok)
+	}
+
+	if _, _, ok, _ := selectSystemdFD("bathroom"); ok {
+		t.Fatal("expected ok=false for a name that isn't in LISTEN_FDNAMES")
+	}
+}
+
+func TestAdoptListenerFD(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to create test listener: %s", err)
+	}
+	defer ln.Close()
+
+	f, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatalf("failed to dup test listener: %s", err)
+	}
+	defer f.Close()
+
+	adopted, err := adoptListenerFD(f.Fd(), "test")
+	if err != nil {
+		t.Fatalf("adoptListenerFD returned error: %s", err)
+	}
+	defer adopted.Close()
+
+	if adopted.Addr().String() != ln.Addr().String() {
+		t.Fatalf("expected adopted listener to share the original address, got %s vs %s", adopted.Addr(), ln.Addr())
+	}
+}
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// SignalContext returns a context that is cancelled when the process
+// receives SIGINT or SIGTERM, plus a CancelFunc that cancels it directly
+// (e.g. from a caller's own Stop method) and stops watching for the signal.
+//
+// Server.ListenAndServe used to own SIGINT/SIGTERM handling itself; now that
+// it just blocks on a caller-provided ctx, something has to create that ctx
+// and cancel it on interrupt. This is that piece: hc.IPTransport's
+// Start/Stop call it rather than each re-implementing process-level signal
+// handling.
+func SignalContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case <-sig:
+			log.Println("[INFO] Received interrupt, shutting down")
+			cancel()
+		case <-ctx.Done():
+		}
+
+		signal.Stop(sig)
+	}()
+
+	return ctx, cancel
+}